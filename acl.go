@@ -0,0 +1,283 @@
+package main
+
+/*
+ * acl.go
+ * Per-source CIDR allow/deny, query ACLs, and token-bucket rate limiting
+ * By J. Stuart McMurray
+ * Created 20190927
+ * Last Modified 20190927
+ */
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// typeANY is the QTYPE for an ANY query (RFC 1035 3.2.3).
+const typeANY = dnsmessage.TypeALL
+
+// defaultMaxBuckets bounds the number of per-source token buckets an ACL
+// keeps at once, if an ACLConfig doesn't say otherwise; without a bound, a
+// flood of spoofed UDP source addresses would grow the bucket map without
+// limit.
+const defaultMaxBuckets = 10000
+
+/* ACLConfig is the on-disk shape of a -acl configuration file. */
+type ACLConfig struct {
+	/* Allow, if non-empty, means only these source CIDRs may query */
+	Allow []string `json:"allow"`
+	/* Deny source CIDRs are always refused, checked before Allow */
+	Deny []string `json:"deny"`
+	/* RateQPS and RateBurst configure a per-source token-bucket rate
+	limit; a zero RateQPS disables rate limiting */
+	RateQPS   float64 `json:"rate_qps"`
+	RateBurst int     `json:"rate_burst"`
+	/* RateMaxSources bounds how many source IPs' token buckets are kept
+	at once, evicting the least-recently-seen once the bound is hit (0
+	means defaultMaxBuckets) */
+	RateMaxSources int `json:"rate_max_sources"`
+	/* DenyQTypes are RR type mnemonics (or "ANY") which are always
+	refused, e.g. ["ANY"] */
+	DenyQTypes []string `json:"deny_qtypes"`
+	/* DenySuffixes are lowercase, trailing-dot qname suffixes which are
+	always refused, e.g. ["ads.example.com."] */
+	DenySuffixes []string `json:"deny_suffixes"`
+}
+
+/* LoadACLConfig reads and parses an ACLConfig from file. */
+func LoadACLConfig(file string) (*ACLConfig, error) {
+	b, err := ioutil.ReadFile(file)
+	if nil != err {
+		return nil, fmt.Errorf("reading %v: %w", file, err)
+	}
+	var c ACLConfig
+	if err := json.Unmarshal(b, &c); nil != err {
+		return nil, fmt.Errorf("parsing %v: %w", file, err)
+	}
+	return &c, nil
+}
+
+// ACL enforces an ACLConfig's source allow/deny lists, query-type and
+// qname-suffix deny lists, and per-source rate limit.
+type ACL struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+
+	rateQPS    float64
+	rateBurst  int
+	maxBuckets int
+
+	denyTypes    map[dnsmessage.Type]bool
+	denySuffixes []string
+
+	mu      sync.Mutex
+	buckets map[string]*bucketEntry
+	lru     *list.List /* front = most recently used */
+}
+
+// bucketEntry is one source's token bucket, tracked in ACL.lru for
+// eviction.
+type bucketEntry struct {
+	key  string
+	tb   *tokenBucket
+	elem *list.Element
+}
+
+/* NewACL builds an ACL from c. */
+func NewACL(c *ACLConfig) (*ACL, error) {
+	maxBuckets := c.RateMaxSources
+	if 0 >= maxBuckets {
+		maxBuckets = defaultMaxBuckets
+	}
+	a := &ACL{
+		rateQPS:    c.RateQPS,
+		rateBurst:  c.RateBurst,
+		maxBuckets: maxBuckets,
+		denyTypes:  make(map[dnsmessage.Type]bool),
+		buckets:    make(map[string]*bucketEntry),
+		lru:        list.New(),
+	}
+	for _, s := range c.Allow {
+		_, n, err := net.ParseCIDR(s)
+		if nil != err {
+			return nil, fmt.Errorf("invalid allow CIDR %q: %w", s, err)
+		}
+		a.allow = append(a.allow, n)
+	}
+	for _, s := range c.Deny {
+		_, n, err := net.ParseCIDR(s)
+		if nil != err {
+			return nil, fmt.Errorf("invalid deny CIDR %q: %w", s, err)
+		}
+		a.deny = append(a.deny, n)
+	}
+	for _, s := range c.DenyQTypes {
+		if "ANY" == strings.ToUpper(s) {
+			a.denyTypes[typeANY] = true
+			continue
+		}
+		t, ok := dnsTypeByName[strings.ToUpper(s)]
+		if !ok {
+			return nil, fmt.Errorf("unknown qtype %q in deny_qtypes", s)
+		}
+		a.denyTypes[t] = true
+	}
+	for _, s := range c.DenySuffixes {
+		a.denySuffixes = append(a.denySuffixes, strings.ToLower(s))
+	}
+	return a, nil
+}
+
+/* Permit reports whether a query for q from addr should be allowed. */
+func (a *ACL) Permit(addr net.Addr, q dnsmessage.Question) bool {
+	if a.denyTypes[q.Type] {
+		return false
+	}
+	name := strings.ToLower(q.Name.String())
+	for _, s := range a.denySuffixes {
+		if matchesSuffix(name, s) {
+			return false
+		}
+	}
+
+	ip := addrIP(addr)
+	if nil == ip {
+		return true /* Can't tell who asked; don't misbehave */
+	}
+
+	for _, n := range a.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if 0 != len(a.allow) {
+		ok := false
+		for _, n := range a.allow {
+			if n.Contains(ip) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+
+	if 0 != a.rateQPS && !a.allowRate(ip.String()) {
+		return false
+	}
+	return true
+}
+
+// matchesSuffix reports whether name is s or a subdomain of s, both
+// trailing-dot qnames.  Plain strings.HasSuffix would also match unrelated
+// names that merely end with the same characters (e.g. "notexample.com."
+// against suffix "example.com."), which isn't what a deny_suffixes author
+// expects.
+func matchesSuffix(name, s string) bool {
+	s = strings.TrimPrefix(s, ".")
+	return name == s || strings.HasSuffix(name, "."+s)
+}
+
+// allowRate consults (creating if necessary) key's token bucket, evicting
+// the least-recently-seen bucket if this pushes the bucket count over
+// a.maxBuckets.  This bounds memory use against a flood of spoofed source
+// addresses, at the cost of occasionally resetting a legitimate source's
+// bucket early.
+func (a *ACL) allowRate(key string) bool {
+	a.mu.Lock()
+	ent, ok := a.buckets[key]
+	if ok {
+		a.lru.MoveToFront(ent.elem)
+	} else {
+		ent = &bucketEntry{key: key, tb: newTokenBucket(a.rateQPS, a.rateBurst)}
+		ent.elem = a.lru.PushFront(ent)
+		a.buckets[key] = ent
+		for len(a.buckets) > a.maxBuckets {
+			oldest := a.lru.Back().Value.(*bucketEntry)
+			a.lru.Remove(oldest.elem)
+			delete(a.buckets, oldest.key)
+		}
+	}
+	a.mu.Unlock()
+	return ent.tb.Allow()
+}
+
+/* addrIP extracts the IP from a UDP or TCP net.Addr. */
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if nil != err {
+			return nil
+		}
+		return net.ParseIP(host)
+	}
+}
+
+// refusedResponse builds a REFUSED answer to q, with the query's original
+// ID, for an ACL-denied query.
+func refusedResponse(id uint16, q dnsmessage.Question) dnsmessage.Message {
+	return dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:       id,
+			Response: true,
+			RCode:    dnsmessage.RCodeRefused,
+		},
+		Questions: []dnsmessage.Question{q},
+	}
+}
+
+/* tokenBucket is a simple per-source token-bucket rate limiter. */
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 /* tokens/second */
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket makes a tokenBucket allowing rate queries/second, up to
+// burst at once.  A non-positive burst is treated as 1.
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if 0 >= burst {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+/* Allow reports whether a query may proceed now, consuming a token if so. */
+func (b *tokenBucket) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if 1 > b.tokens {
+		return false
+	}
+	b.tokens--
+	return true
+}
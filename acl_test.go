@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func mustName(t *testing.T, s string) dnsmessage.Name {
+	t.Helper()
+	n, err := dnsmessage.NewName(s)
+	if nil != err {
+		t.Fatalf("building name %q: %v", s, err)
+	}
+	return n
+}
+
+func TestACLPermitDenySuffixes(t *testing.T) {
+	a, err := NewACL(&ACLConfig{
+		DenySuffixes: []string{"example.com."},
+	})
+	if nil != err {
+		t.Fatalf("NewACL: %v", err)
+	}
+
+	addr := &net.UDPAddr{IP: net.ParseIP("192.0.2.1")}
+	for _, c := range []struct {
+		name  string
+		allow bool
+	}{
+		{"example.com.", false},
+		{"www.example.com.", false},
+		{"notexample.com.", true},
+		{"evilexample.com.", true},
+		{"other.org.", true},
+	} {
+		q := dnsmessage.Question{
+			Name:  mustName(t, c.name),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		}
+		if got := a.Permit(addr, q); got != c.allow {
+			t.Errorf("Permit(%q) = %v, want %v", c.name, got, c.allow)
+		}
+	}
+}
+
+func TestTokenBucketAllow(t *testing.T) {
+	b := newTokenBucket(1, 3)
+
+	for i := 0; i < 3; i++ {
+		if !b.Allow() {
+			t.Fatalf("Allow() #%d = false, want true (within burst)", i)
+		}
+	}
+	if b.Allow() {
+		t.Fatal("Allow() = true after burst exhausted, want false")
+	}
+
+	/* Back-date last so Allow sees enough elapsed time to refill a token,
+	rather than sleeping for real in a test. */
+	b.last = b.last.Add(-1 * time.Second)
+	if !b.Allow() {
+		t.Error("Allow() = false after refill, want true")
+	}
+	if b.Allow() {
+		t.Error("Allow() = true with only one token refilled, want false")
+	}
+}
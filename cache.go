@@ -0,0 +1,217 @@
+package main
+
+/*
+ * cache.go
+ * In-memory, TTL-aware, size-bounded LRU cache of DNS answers
+ * By J. Stuart McMurray
+ * Created 20190926
+ * Last Modified 20190926
+ */
+
+import (
+	"container/list"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+/* cacheKey identifies a cached answer by the question that was asked. */
+type cacheKey struct {
+	name  string /* canonicalised: lowercase, trailing dot */
+	qtype dnsmessage.Type
+	class dnsmessage.Class
+}
+
+/* newCacheKey builds a cacheKey from q, canonicalising its name. */
+func newCacheKey(q dnsmessage.Question) cacheKey {
+	return cacheKey{
+		name:  strings.ToLower(q.Name.String()),
+		qtype: q.Type,
+		class: q.Class,
+	}
+}
+
+/* cacheEntry is one cached answer. */
+type cacheEntry struct {
+	key      cacheKey
+	rm       dnsmessage.Message
+	ttl      time.Duration /* TTL at the time of insertion */
+	inserted time.Time
+	elem     *list.Element
+}
+
+// Cache is an in-memory, size-bounded LRU cache of DNS answers, keyed on
+// (qname, qtype, qclass).  It also serves as an http.Handler exposing hit/
+// miss/expired counters for -metrics.
+type Cache struct {
+	minTTL, maxTTL time.Duration
+	maxSize        int
+
+	mu      sync.Mutex
+	entries map[cacheKey]*cacheEntry
+	lru     *list.List /* front = most recently used */
+
+	hits, misses, expired uint64 /* atomic */
+}
+
+// NewCache makes a Cache which holds at most maxSize entries (0 means
+// unbounded) and clamps cached TTLs to [minTTL, maxTTL] (maxTTL of 0 means no
+// upper clamp).
+func NewCache(maxSize int, minTTL, maxTTL time.Duration) *Cache {
+	return &Cache{
+		minTTL:  minTTL,
+		maxTTL:  maxTTL,
+		maxSize: maxSize,
+		entries: make(map[cacheKey]*cacheEntry),
+		lru:     list.New(),
+	}
+}
+
+// Get looks up the answer to q, rewriting its ID to id and ageing its
+// records' TTLs by the time since it was cached.  The second return value is
+// false on a cache miss (including an expired entry).
+func (c *Cache) Get(q dnsmessage.Question, id uint16) (dnsmessage.Message, bool) {
+	key := newCacheKey(q)
+
+	c.mu.Lock()
+	ent, ok := c.entries[key]
+	if !ok {
+		c.mu.Unlock()
+		atomic.AddUint64(&c.misses, 1)
+		return dnsmessage.Message{}, false
+	}
+
+	elapsed := time.Since(ent.inserted)
+	if elapsed >= ent.ttl {
+		c.removeLocked(ent)
+		c.mu.Unlock()
+		atomic.AddUint64(&c.expired, 1)
+		return dnsmessage.Message{}, false
+	}
+	c.lru.MoveToFront(ent.elem)
+	rm := cloneMessage(ent.rm)
+	c.mu.Unlock()
+
+	atomic.AddUint64(&c.hits, 1)
+	ageTTLs(&rm, uint32(elapsed.Seconds()))
+	rm.ID = id
+	return rm, true
+}
+
+// Put caches rm as the answer to q, using the minimum Answer TTL (or, for
+// a negative response, the SOA MINIMUM per RFC 2308) clamped to [minTTL,
+// maxTTL].  A zero resulting TTL isn't cached.
+func (c *Cache) Put(q dnsmessage.Question, rm dnsmessage.Message) {
+	ttl := c.clampTTL(answerTTL(rm))
+	if 0 == ttl {
+		return
+	}
+	key := newCacheKey(q)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old, ok := c.entries[key]; ok {
+		c.removeLocked(old)
+	}
+	ent := &cacheEntry{
+		key:      key,
+		rm:       cloneMessage(rm),
+		ttl:      ttl,
+		inserted: time.Now(),
+	}
+	ent.elem = c.lru.PushFront(ent)
+	c.entries[key] = ent
+
+	for 0 != c.maxSize && len(c.entries) > c.maxSize {
+		c.removeLocked(c.lru.Back().Value.(*cacheEntry))
+	}
+}
+
+/* clampTTL clamps ttl to [c.minTTL, c.maxTTL]. */
+func (c *Cache) clampTTL(ttl time.Duration) time.Duration {
+	if ttl < c.minTTL {
+		ttl = c.minTTL
+	}
+	if 0 != c.maxTTL && ttl > c.maxTTL {
+		ttl = c.maxTTL
+	}
+	return ttl
+}
+
+/* removeLocked removes ent from the cache.  c.mu must be held. */
+func (c *Cache) removeLocked(ent *cacheEntry) {
+	c.lru.Remove(ent.elem)
+	delete(c.entries, ent.key)
+}
+
+/* ServeHTTP serves -metrics, a plain-text counter dump. */
+func (c *Cache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "# TYPE dns2googledoh_cache_hits_total counter\n")
+	fmt.Fprintf(w, "dns2googledoh_cache_hits_total %d\n", atomic.LoadUint64(&c.hits))
+	fmt.Fprintf(w, "# TYPE dns2googledoh_cache_misses_total counter\n")
+	fmt.Fprintf(w, "dns2googledoh_cache_misses_total %d\n", atomic.LoadUint64(&c.misses))
+	fmt.Fprintf(w, "# TYPE dns2googledoh_cache_expired_total counter\n")
+	fmt.Fprintf(w, "dns2googledoh_cache_expired_total %d\n", atomic.LoadUint64(&c.expired))
+}
+
+// answerTTL returns the TTL a response should be cached for: the minimum
+// Answer RR TTL, or for a negative response (no answers), the authority
+// section's SOA MINIMUM field, per RFC 2308.
+func answerTTL(rm dnsmessage.Message) time.Duration {
+	var (
+		min   uint32
+		found bool
+	)
+	for _, a := range rm.Answers {
+		if !found || a.Header.TTL < min {
+			min = a.Header.TTL
+			found = true
+		}
+	}
+	if found {
+		return time.Duration(min) * time.Second
+	}
+	for _, a := range rm.Authorities {
+		if soa, ok := a.Body.(*dnsmessage.SOAResource); ok {
+			return time.Duration(soa.MinTTL) * time.Second
+		}
+	}
+	return 0
+}
+
+// cloneMessage makes a copy of m whose resource-record slices can be
+// mutated (e.g. to age TTLs) without affecting m.
+func cloneMessage(m dnsmessage.Message) dnsmessage.Message {
+	clone := m
+	clone.Questions = append([]dnsmessage.Question(nil), m.Questions...)
+	clone.Answers = append([]dnsmessage.Resource(nil), m.Answers...)
+	clone.Authorities = append([]dnsmessage.Resource(nil), m.Authorities...)
+	clone.Additionals = append([]dnsmessage.Resource(nil), m.Additionals...)
+	return clone
+}
+
+// ageTTLs decrements every non-OPT record's TTL in m by elapsed seconds,
+// floored at 0.
+func ageTTLs(m *dnsmessage.Message, elapsed uint32) {
+	for _, sec := range [][]dnsmessage.Resource{
+		m.Answers,
+		m.Authorities,
+		m.Additionals,
+	} {
+		for i := range sec {
+			if dnsmessage.TypeOPT == sec[i].Header.Type {
+				continue
+			}
+			if sec[i].Header.TTL > elapsed {
+				sec[i].Header.TTL -= elapsed
+			} else {
+				sec[i].Header.TTL = 0
+			}
+		}
+	}
+}
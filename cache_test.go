@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestAgeTTLs(t *testing.T) {
+	name := mustName(t, "example.com.")
+	rr := func(typ dnsmessage.Type, ttl uint32) dnsmessage.Resource {
+		var body dnsmessage.ResourceBody
+		if dnsmessage.TypeOPT == typ {
+			body = &dnsmessage.OPTResource{}
+		} else {
+			body = &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}}
+		}
+		return dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{
+				Name:  name,
+				Type:  typ,
+				Class: dnsmessage.ClassINET,
+				TTL:   ttl,
+			},
+			Body: body,
+		}
+	}
+
+	m := dnsmessage.Message{
+		Answers:     []dnsmessage.Resource{rr(dnsmessage.TypeA, 300)},
+		Authorities: []dnsmessage.Resource{rr(dnsmessage.TypeA, 10)},
+		Additionals: []dnsmessage.Resource{
+			rr(dnsmessage.TypeA, 5),
+			rr(dnsmessage.TypeOPT, 1<<15),
+		},
+	}
+
+	ageTTLs(&m, 15)
+
+	if got, want := m.Answers[0].Header.TTL, uint32(285); got != want {
+		t.Errorf("Answers[0].TTL = %d, want %d", got, want)
+	}
+	if got, want := m.Authorities[0].Header.TTL, uint32(0); got != want {
+		t.Errorf("Authorities[0].TTL = %d, want %d (should floor, not underflow)", got, want)
+	}
+	if got, want := m.Additionals[0].Header.TTL, uint32(0); got != want {
+		t.Errorf("Additionals[0].TTL = %d, want %d", got, want)
+	}
+	if got, want := m.Additionals[1].Header.TTL, uint32(1<<15); got != want {
+		t.Errorf("OPT record TTL = %d, want untouched %d", got, want)
+	}
+}
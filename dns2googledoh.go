@@ -7,21 +7,16 @@ package main
  * Proxies DNS over domain-fronted Google DoH
  * By J. Stuart McMurray
  * Created 20190921
- * Last Modified 20190921
+ * Last Modified 20190926
  */
 
 import (
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"net"
 	"net/http"
-	"net/http/httputil"
 	"os"
-	"sync"
-
-	"golang.org/x/net/dns/dnsmessage"
+	"time"
 )
 
 const (
@@ -29,6 +24,11 @@ const (
 	buflen = 2048
 	/* host is the host header to use to get to Google's DoH */
 	host = "dns.google.com"
+
+	/* modeJSON is the Google JSON DoH API, /resolve?name=&type= */
+	modeJSON = "json"
+	/* modeWire is RFC 8484 wire-format DoH, /dns-query */
+	modeWire = "wire"
 )
 
 func main() {
@@ -36,13 +36,94 @@ func main() {
 		sni = flag.String(
 			"sni",
 			"youtube.com",
-			"TLS `SNI`",
+			"TLS `SNI`, used for the default Google upstream "+
+				"when no -upstream is given",
 		)
 		laddr = flag.String(
 			"listen",
 			"0.0.0.0:5353",
 			"Listen `address`",
 		)
+		mode = flag.String(
+			"mode",
+			modeJSON,
+			"DoH query `mode` for the default Google upstream, "+
+				"either "+modeJSON+" (Google's JSON API) or "+
+				modeWire+" (RFC 8484 wire-format DoH)",
+		)
+		race = flag.Int(
+			"race",
+			2,
+			"Query up to this many upstreams in parallel per "+
+				"lookup (0 races them all)",
+		)
+		backupDelay = flag.Duration(
+			"backup-delay",
+			200*time.Millisecond,
+			"Delay before querying each successive backup "+
+				"upstream in a race",
+		)
+		serveDoHAddr = flag.String(
+			"serve-doh",
+			"",
+			"Instead of proxying, serve DoH requests on this "+
+				"`address` and forward them as classic DNS "+
+				"queries to -serve-doh-upstream",
+		)
+		serveDoHCert = flag.String(
+			"serve-doh-cert",
+			"",
+			"TLS certificate `file` for -serve-doh",
+		)
+		serveDoHKey = flag.String(
+			"serve-doh-key",
+			"",
+			"TLS key `file` for -serve-doh",
+		)
+		serveDoHUpstream = flag.String(
+			"serve-doh-upstream",
+			"8.8.8.8:53",
+			"Classic DNS server `address` to which -serve-doh "+
+				"requests are forwarded",
+		)
+		cacheSize = flag.Int(
+			"cache-size",
+			10000,
+			"Maximum number of answers to cache (0 disables "+
+				"the cache)",
+		)
+		minTTL = flag.Duration(
+			"min-ttl",
+			0,
+			"Clamp cached answers' TTLs to at least this long",
+		)
+		maxTTL = flag.Duration(
+			"max-ttl",
+			time.Hour,
+			"Clamp cached answers' TTLs to at most this long "+
+				"(0 means no maximum)",
+		)
+		metricsAddr = flag.String(
+			"metrics",
+			"",
+			"Serve cache hit/miss/expired counters on this "+
+				"`address` (disabled if empty)",
+		)
+		aclFile = flag.String(
+			"acl",
+			"",
+			"JSON `file` with source CIDR allow/deny lists, a "+
+				"per-source rate limit, and a qtype/qname "+
+				"deny list (disabled if empty)",
+		)
+	)
+	var upstreams upstreamFlag
+	flag.Var(
+		&upstreams,
+		"upstream",
+		"Upstream DoH/DoT server (may be repeated); forms are "+
+			"google:<sni>[,json|,wire], doh:<url>, and "+
+			"dot:<host:port>",
 	)
 	flag.Usage = func() {
 		fmt.Fprintf(
@@ -59,153 +140,79 @@ Options:
 	}
 	flag.Parse()
 
-	/* Make sure we have a server to call to */
-	if "" == *sni {
-		log.Fatalf("SNI not set (-sni)")
+	/* -serve-doh runs the proxy backwards: serve DoH and forward to a
+	classic DNS server, rather than proxy classic DNS to a DoH server. */
+	if "" != *serveDoHAddr {
+		if "" == *serveDoHCert || "" == *serveDoHKey {
+			log.Fatalf(
+				"-serve-doh-cert and -serve-doh-key are " +
+					"both required with -serve-doh",
+			)
+		}
+		log.Fatalf(
+			"Error serving DoH: %v",
+			serveDoH(
+				*serveDoHAddr,
+				*serveDoHCert,
+				*serveDoHKey,
+				*serveDoHUpstream,
+			),
+		)
 	}
 
-	/* Listen for DNS queries */
-	la, err := net.ResolveUDPAddr("udp", *laddr)
-	if nil != err {
-		log.Fatalf("Unable to resolve UDP address %v: %v", *laddr, err)
-	}
-	uc, err := net.ListenUDP("udp", la)
-	if nil != err {
-		log.Fatalf("Unable to listen on %v: %v", la, err)
+	/* Without an explicit -upstream, fall back to the single
+	domain-fronted Google upstream the old -sni/-mode flags describe. */
+	specs := []string(upstreams)
+	if 0 == len(specs) {
+		if "" == *sni {
+			log.Fatalf("SNI not set (-sni)")
+		}
+		specs = []string{fmt.Sprintf("google:%s,%s", *sni, *mode)}
 	}
-	log.Printf("Listening for DNS queries on %v", uc.LocalAddr())
-
-	/* Handle DNS queries */
-	pool := &sync.Pool{New: func() interface{} {
-		return make([]byte, buflen)
-	}}
-	for {
-		/* Get a query */
-		b := pool.Get().([]byte)
-		n, a, err := uc.ReadFrom(b)
+	ups := make([]Upstream, 0, len(specs))
+	for _, spec := range specs {
+		u, err := parseUpstream(spec)
 		if nil != err {
-			log.Fatalf("Error getting UDP query: %v", err)
+			log.Fatalf("Invalid -upstream %q: %v", spec, err)
 		}
-		/* Proxy and return it */
-		go func() {
-			handleQuery(uc, a, b[:n], *sni)
-			pool.Put(b)
-		}()
+		ups = append(ups, u)
 	}
-}
-
-/* handleQuery proxies the query to a DoH server and returns the result */
-func handleQuery(uc *net.UDPConn, a net.Addr, b []byte, sni string) {
-	tag := a.String()
+	pool := NewPool(ups, *race, *backupDelay)
 
-	/* Make sure the query is a DNS query */
-	var m dnsmessage.Message
-	if err := m.Unpack(b); nil != err {
-		log.Printf("[%v] Invalid query: %v", tag, err)
-		return
+	/* A nil cache disables caching entirely */
+	var cache *Cache
+	if 0 != *cacheSize {
+		cache = NewCache(*cacheSize, *minTTL, *maxTTL)
 	}
 
-	/* We only support one question at a time */
-	switch len(m.Questions) {
-	case 0:
-		log.Printf("[%v] No questions in query", tag)
-		return
-	case 1: /* This is what we expect */
-	default:
-		log.Printf(
-			"[%v] Got %v questions in query, but only "+
-				"1 question is supported",
-			tag,
-			len(m.Questions),
-		)
-		return
-	}
-
-	/* We'll need to stick the ID in the repsonse */
-	id := m.ID
-
-	/* Now that we've parsed the query, make a better logging tag */
-	tag = fmt.Sprintf(
-		"%s-%s/%s",
-		a,
-		m.Questions[0].Name,
-		m.Questions[0].Type,
-	)
-
-	/* Roll an HTTP request for the DNS query */
-	req, err := http.NewRequest(
-		http.MethodGet,
-		fmt.Sprintf(
-			"https://"+sni+"/resolve"+
-				"?name=%s"+
-				"&type=%d"+
-				"&ct=application/dns-message",
-			m.Questions[0].Name,
-			m.Questions[0].Type,
-		),
-		nil,
-	)
-	if nil != err {
-		log.Printf("[%v] Error creating HTTPS request: %v", tag, err)
-		return
-	}
-	req.Host = host
-	o, err := httputil.DumpRequest(req, true) /* DEBUG */
-	if nil != err {
-		panic(err)
-	} /* DEBUG */
-	log.Printf("o: %q", o) /* DEBUG */
-
-	/* Send forth the request */
-	res, err := http.DefaultClient.Do(req)
-	if nil != err {
-		log.Printf("[%v] Error making HTTPS query: %v", tag, err)
-		return
-	}
-	defer res.Body.Close()
-
-	/* Make sure we got it back */
-	rb, err := ioutil.ReadAll(res.Body)
-	if nil != err {
-		log.Printf("[%v] Error reading HTTPS response: %v", tag, err)
-		return
-	}
-	if http.StatusOK != res.StatusCode {
-		if 0 == len(rb) {
-			log.Printf(
-				"[%v] Non-OK HTTP response: %v",
-				tag,
-				res.Status,
-			)
-		} else {
-			log.Printf("[%v] Non-OK HTTP response: %v (%q)",
-				tag,
-				res.Status,
-				rb,
-			)
+	/* A nil acl disables ACL enforcement entirely */
+	var acl *ACL
+	if "" != *aclFile {
+		c, err := LoadACLConfig(*aclFile)
+		if nil != err {
+			log.Fatalf("Loading -acl %v: %v", *aclFile, err)
+		}
+		acl, err = NewACL(c)
+		if nil != err {
+			log.Fatalf("Parsing -acl %v: %v", *aclFile, err)
 		}
-		return
-	}
-	if 0 == len(rb) {
-		log.Printf("[%v] Empty HTTPS response body", a)
-		return
 	}
-
-	/* Make sure the body is also DNS and put back the ID */
-	if err := m.Unpack(rb); nil != err {
-		log.Printf("[%v] Invalid DNS response %q: %v", a, rb, err)
-		return
+	if "" != *metricsAddr {
+		if nil == cache {
+			log.Fatalf("-metrics requires a non-zero -cache-size")
+		}
+		go func() {
+			log.Fatalf(
+				"Error serving -metrics: %v",
+				http.ListenAndServe(*metricsAddr, cache),
+			)
+		}()
 	}
-	m.ID = id
 
-	/* Send the response back */
-	rb, err = m.AppendPack(rb[:0])
-	if nil != err {
-		log.Printf("[%v] Error packing DNS response: %v", a, err)
-		return
-	}
-	if _, err := uc.WriteTo(rb, a); nil != err {
-		log.Printf("[%v] Error sending response: %v", err)
-	}
-	log.Printf("[%v] %s %s", a, m.Questions[0].Name, m.Questions[0].Type)
+	/* Listen for DNS queries on both UDP and TCP, so clients which
+	retry over TCP after a truncated UDP answer are served as well. */
+	ech := make(chan error, 2)
+	go func() { ech <- serveUDP(*laddr, pool, cache, acl) }()
+	go func() { ech <- serveTCP(*laddr, pool, cache, acl) }()
+	log.Fatalf("Error serving DNS queries: %v", <-ech)
 }
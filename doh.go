@@ -0,0 +1,361 @@
+package main
+
+/*
+ * doh.go
+ * Sends queries to a DoH server, either via Google's JSON API or RFC 8484
+ * By J. Stuart McMurray
+ * Created 20190922
+ * Last Modified 20190922
+ */
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+/* ctDNSMessage is the RFC 8484 wire-format content type */
+const ctDNSMessage = "application/dns-message"
+
+// maxGETQueryLen bounds how long a GET ?dns= URL is allowed to get before
+// newWireRequest falls back to POST; RFC 8484 doesn't set a limit, but
+// some servers and middleboxes balk at very long URLs.
+const maxGETQueryLen = 2048
+
+// queryJSON sends m to sni using Google's JSON DoH API (/resolve), but asks
+// for the reply in wire format via ct=application/dns-message, which Google
+// happily provides.
+func queryJSON(ctx context.Context, m dnsmessage.Message, sni string) (dnsmessage.Message, error) {
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodGet,
+		fmt.Sprintf(
+			"https://"+sni+"/resolve"+
+				"?name=%s"+
+				"&type=%d"+
+				"&ct="+ctDNSMessage,
+			m.Questions[0].Name,
+			m.Questions[0].Type,
+		),
+		nil,
+	)
+	if nil != err {
+		return dnsmessage.Message{}, fmt.Errorf(
+			"creating request: %w",
+			err,
+		)
+	}
+	req.Host = host
+	return doDoHRequest(req)
+}
+
+// queryWire sends m to sni as a RFC 8484 wire-format DoH query, GET with a
+// dns= base64url parameter if the encoded query is short enough, otherwise
+// POSTed to /dns-query with a Content-Type of application/dns-message.
+func queryWire(ctx context.Context, m dnsmessage.Message, sni string) (dnsmessage.Message, error) {
+	req, err := newWireRequest(ctx, "https://"+sni+"/dns-query", m)
+	if nil != err {
+		return dnsmessage.Message{}, err
+	}
+	req.Host = host
+	return doDoHRequest(req)
+}
+
+// newWireRequest builds a RFC 8484 wire-format DoH request for m against
+// url: GET with a dns= base64url parameter if the encoded query fits
+// within maxGETQueryLen, otherwise POST with a Content-Type of
+// application/dns-message.
+func newWireRequest(ctx context.Context, url string, m dnsmessage.Message) (*http.Request, error) {
+	qb, err := m.Pack()
+	if nil != err {
+		return nil, fmt.Errorf("packing query: %w", err)
+	}
+
+	enc := base64.RawURLEncoding.EncodeToString(qb)
+	if getURL := url + "?dns=" + enc; len(getURL) <= maxGETQueryLen {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, getURL, nil)
+		if nil != err {
+			return nil, fmt.Errorf("creating request: %w", err)
+		}
+		req.Header.Set("Accept", ctDNSMessage)
+		return req, nil
+	}
+
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		url,
+		bytes.NewReader(qb),
+	)
+	if nil != err {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", ctDNSMessage)
+	req.Header.Set("Accept", ctDNSMessage)
+	return req, nil
+}
+
+// doDoHRequest sends req, whose Host must already be set if it is to be
+// domain fronted, and unpacks the response as a DNS message.  If the server
+// replies with JSON instead of wire-format DNS (some DoH servers do this
+// regardless of what was asked for), the JSON is parsed into an equivalent
+// dnsmessage.Message instead of returning an error.
+func doDoHRequest(req *http.Request) (dnsmessage.Message, error) {
+	res, err := http.DefaultClient.Do(req)
+	if nil != err {
+		return dnsmessage.Message{}, fmt.Errorf(
+			"making HTTPS request: %w",
+			err,
+		)
+	}
+	defer res.Body.Close()
+
+	rb, err := ioutil.ReadAll(res.Body)
+	if nil != err {
+		return dnsmessage.Message{}, fmt.Errorf(
+			"reading response body: %w",
+			err,
+		)
+	}
+	if http.StatusOK != res.StatusCode {
+		if 0 == len(rb) {
+			return dnsmessage.Message{}, fmt.Errorf(
+				"non-OK HTTP response: %v",
+				res.Status,
+			)
+		}
+		return dnsmessage.Message{}, fmt.Errorf(
+			"non-OK HTTP response: %v (%q)",
+			res.Status,
+			rb,
+		)
+	}
+	if 0 == len(rb) {
+		return dnsmessage.Message{}, fmt.Errorf("empty response body")
+	}
+
+	/* Some DoH servers send back JSON regardless of what Accept/ct
+	asked for; fall back to parsing it as Google's JSON DoH API shape
+	rather than erroring. */
+	if ct := res.Header.Get("Content-Type"); "" != ct && ct != ctDNSMessage {
+		rm, jerr := parseDoHJSONMessage(rb)
+		if nil != jerr {
+			return dnsmessage.Message{}, fmt.Errorf(
+				"unexpected response Content-Type %q, and "+
+					"failed to parse as DoH JSON: %w",
+				ct,
+				jerr,
+			)
+		}
+		return rm, nil
+	}
+
+	var rm dnsmessage.Message
+	if err := rm.Unpack(rb); nil != err {
+		return dnsmessage.Message{}, fmt.Errorf(
+			"unpacking response %q: %w",
+			rb,
+			err,
+		)
+	}
+	return rm, nil
+}
+
+// parseDoHJSONMessage parses rb, a Google-style JSON DoH API response body
+// (the shape produced by newDoHJSONResponse in servedoh.go), into the
+// equivalent dnsmessage.Message.
+func parseDoHJSONMessage(rb []byte) (dnsmessage.Message, error) {
+	var body dohJSONResponseBody
+	if err := json.Unmarshal(rb, &body); nil != err {
+		return dnsmessage.Message{}, fmt.Errorf(
+			"parsing JSON response %q: %w",
+			rb,
+			err,
+		)
+	}
+
+	m := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			Response:           true,
+			RecursionDesired:   body.RD,
+			RecursionAvailable: body.RA,
+			Truncated:          body.TC,
+			RCode:              dnsmessage.RCode(body.Status),
+		},
+	}
+	for _, q := range body.Question {
+		name, err := dnsmessage.NewName(dnsName(q.Name))
+		if nil != err {
+			return dnsmessage.Message{}, fmt.Errorf(
+				"invalid question name %q: %w",
+				q.Name,
+				err,
+			)
+		}
+		m.Questions = append(m.Questions, dnsmessage.Question{
+			Name:  name,
+			Type:  dnsmessage.Type(q.Type),
+			Class: dnsmessage.ClassINET,
+		})
+	}
+	for _, a := range body.Answer {
+		name, err := dnsmessage.NewName(dnsName(a.Name))
+		if nil != err {
+			return dnsmessage.Message{}, fmt.Errorf(
+				"invalid answer name %q: %w",
+				a.Name,
+				err,
+			)
+		}
+		rrb, err := parseRRData(dnsmessage.Type(a.Type), a.Data)
+		if nil != err {
+			return dnsmessage.Message{}, fmt.Errorf(
+				"parsing %v record data %q: %w",
+				dnsmessage.Type(a.Type),
+				a.Data,
+				err,
+			)
+		}
+		m.Answers = append(m.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{
+				Name:  name,
+				Type:  dnsmessage.Type(a.Type),
+				Class: dnsmessage.ClassINET,
+				TTL:   uint32(a.TTL),
+			},
+			Body: rrb,
+		})
+	}
+	return m, nil
+}
+
+// dnsName ensures name has the trailing dot dnsmessage.NewName requires.
+func dnsName(name string) string {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return name
+}
+
+// parseRRData parses data, rendered the way rrDataString (servedoh.go)
+// renders it, back into a dnsmessage.ResourceBody for the given RR type.
+// Types rrDataString doesn't render specially aren't recognised here
+// either.
+func parseRRData(t dnsmessage.Type, data string) (dnsmessage.ResourceBody, error) {
+	switch t {
+	case dnsmessage.TypeA:
+		ip := net.ParseIP(data).To4()
+		if nil == ip {
+			return nil, fmt.Errorf("invalid IPv4 address %q", data)
+		}
+		var a dnsmessage.AResource
+		copy(a.A[:], ip)
+		return &a, nil
+	case dnsmessage.TypeAAAA:
+		ip := net.ParseIP(data).To16()
+		if nil == ip {
+			return nil, fmt.Errorf("invalid IPv6 address %q", data)
+		}
+		var a dnsmessage.AAAAResource
+		copy(a.AAAA[:], ip)
+		return &a, nil
+	case dnsmessage.TypeCNAME:
+		name, err := dnsmessage.NewName(dnsName(data))
+		if nil != err {
+			return nil, err
+		}
+		return &dnsmessage.CNAMEResource{CNAME: name}, nil
+	case dnsmessage.TypeNS:
+		name, err := dnsmessage.NewName(dnsName(data))
+		if nil != err {
+			return nil, err
+		}
+		return &dnsmessage.NSResource{NS: name}, nil
+	case dnsmessage.TypePTR:
+		name, err := dnsmessage.NewName(dnsName(data))
+		if nil != err {
+			return nil, err
+		}
+		return &dnsmessage.PTRResource{PTR: name}, nil
+	case dnsmessage.TypeMX:
+		fs := strings.SplitN(data, " ", 2)
+		if 2 != len(fs) {
+			return nil, fmt.Errorf("malformed MX data %q", data)
+		}
+		pref, err := strconv.ParseUint(fs[0], 10, 16)
+		if nil != err {
+			return nil, fmt.Errorf("invalid MX preference: %w", err)
+		}
+		name, err := dnsmessage.NewName(dnsName(fs[1]))
+		if nil != err {
+			return nil, err
+		}
+		return &dnsmessage.MXResource{Pref: uint16(pref), MX: name}, nil
+	case dnsmessage.TypeTXT:
+		return &dnsmessage.TXTResource{TXT: []string{data}}, nil
+	case dnsmessage.TypeSRV:
+		fs := strings.SplitN(data, " ", 4)
+		if 4 != len(fs) {
+			return nil, fmt.Errorf("malformed SRV data %q", data)
+		}
+		nums := make([]uint64, 3)
+		for i, f := range fs[:3] {
+			n, err := strconv.ParseUint(f, 10, 16)
+			if nil != err {
+				return nil, fmt.Errorf("invalid SRV field: %w", err)
+			}
+			nums[i] = n
+		}
+		name, err := dnsmessage.NewName(dnsName(fs[3]))
+		if nil != err {
+			return nil, err
+		}
+		return &dnsmessage.SRVResource{
+			Priority: uint16(nums[0]),
+			Weight:   uint16(nums[1]),
+			Port:     uint16(nums[2]),
+			Target:   name,
+		}, nil
+	case dnsmessage.TypeSOA:
+		fs := strings.Fields(data)
+		if 7 != len(fs) {
+			return nil, fmt.Errorf("malformed SOA data %q", data)
+		}
+		ns, err := dnsmessage.NewName(dnsName(fs[0]))
+		if nil != err {
+			return nil, err
+		}
+		mbox, err := dnsmessage.NewName(dnsName(fs[1]))
+		if nil != err {
+			return nil, err
+		}
+		nums := make([]uint64, 5)
+		for i, f := range fs[2:] {
+			n, err := strconv.ParseUint(f, 10, 32)
+			if nil != err {
+				return nil, fmt.Errorf("invalid SOA field: %w", err)
+			}
+			nums[i] = n
+		}
+		return &dnsmessage.SOAResource{
+			NS:      ns,
+			MBox:    mbox,
+			Serial:  uint32(nums[0]),
+			Refresh: uint32(nums[1]),
+			Retry:   uint32(nums[2]),
+			Expire:  uint32(nums[3]),
+			MinTTL:  uint32(nums[4]),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported RR type %v in JSON fallback", t)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+/*
+ * edns.go
+ * EDNS0 UDP payload size handling and UDP response truncation
+ * By J. Stuart McMurray
+ * Created 20190923
+ * Last Modified 20190923
+ */
+
+import "golang.org/x/net/dns/dnsmessage"
+
+// defaultUDPSize is the UDP payload size to assume when a query has no OPT
+// record, per RFC 1035.
+const defaultUDPSize = 512
+
+// ednsUDPSize returns the UDP payload size the client advertised in an
+// OPT record in m's Additional section, or 0 if m has no OPT record.
+func ednsUDPSize(m dnsmessage.Message) int {
+	for _, a := range m.Additionals {
+		if dnsmessage.TypeOPT == a.Header.Type {
+			/* The requestor's UDP payload size is smuggled in
+			the OPT record's class field. */
+			return int(a.Header.Class)
+		}
+	}
+	return 0
+}
+
+// packForUDP packs rm for sending over UDP.  If the packed message is
+// larger than maxSize (or defaultUDPSize, if maxSize is 0), records are
+// dropped, preferring to keep the Answer section, and the TC bit is set, so
+// the client knows to retry over TCP.
+func packForUDP(rm dnsmessage.Message, maxSize int) ([]byte, error) {
+	if 0 == maxSize {
+		maxSize = defaultUDPSize
+	}
+
+	rb, err := rm.Pack()
+	if nil != err {
+		return nil, err
+	}
+	if len(rb) <= maxSize {
+		return rb, nil
+	}
+
+	/* Doesn't fit; drop records, least-important section first, until
+	it does. */
+	rm.Header.Truncated = true
+	for _, sec := range []*[]dnsmessage.Resource{
+		&rm.Additionals,
+		&rm.Authorities,
+		&rm.Answers,
+	} {
+		for 0 != len(*sec) {
+			*sec = (*sec)[:len(*sec)-1]
+			rb, err = rm.Pack()
+			if nil != err {
+				return nil, err
+			}
+			if len(rb) <= maxSize {
+				return rb, nil
+			}
+		}
+	}
+
+	return rb, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestPackForUDPFits(t *testing.T) {
+	name := mustName(t, "example.com.")
+	rm := dnsmessage.Message{
+		Header:    dnsmessage.Header{Response: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+		Answers: []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 300},
+			Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+		}},
+	}
+
+	rb, err := packForUDP(rm, 512)
+	if nil != err {
+		t.Fatalf("packForUDP: %v", err)
+	}
+
+	var got dnsmessage.Message
+	if err := got.Unpack(rb); nil != err {
+		t.Fatalf("Unpack: %v", err)
+	}
+	if got.Header.Truncated {
+		t.Error("Truncated = true for a message that fit")
+	}
+	if 1 != len(got.Answers) {
+		t.Errorf("got %d answers, want 1", len(got.Answers))
+	}
+}
+
+func TestPackForUDPTruncates(t *testing.T) {
+	name := mustName(t, "example.com.")
+	rm := dnsmessage.Message{
+		Header:    dnsmessage.Header{Response: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+	}
+	for i := 0; i < 64; i++ {
+		rm.Answers = append(rm.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 300},
+			Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, byte(i)}},
+		})
+	}
+
+	const maxSize = 128
+	rb, err := packForUDP(rm, maxSize)
+	if nil != err {
+		t.Fatalf("packForUDP: %v", err)
+	}
+	if len(rb) > maxSize {
+		t.Fatalf("packed message is %d bytes, want <= %d", len(rb), maxSize)
+	}
+
+	var got dnsmessage.Message
+	if err := got.Unpack(rb); nil != err {
+		t.Fatalf("Unpack: %v", err)
+	}
+	if !got.Header.Truncated {
+		t.Error("Truncated = false for a message that didn't fit")
+	}
+}
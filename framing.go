@@ -0,0 +1,42 @@
+package main
+
+/*
+ * framing.go
+ * RFC 1035 two-byte length-prefix framing, shared by DNS-over-TCP and -TLS
+ * By J. Stuart McMurray
+ * Created 20190925
+ * Last Modified 20190925
+ */
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+/* readPrefixed reads one RFC 1035 length-prefixed DNS message from r. */
+func readPrefixed(r io.Reader) ([]byte, error) {
+	var lb [2]byte
+	if _, err := io.ReadFull(r, lb[:]); nil != err {
+		return nil, err
+	}
+	b := make([]byte, binary.BigEndian.Uint16(lb[:]))
+	if _, err := io.ReadFull(r, b); nil != err {
+		return nil, fmt.Errorf("reading message: %w", err)
+	}
+	return b, nil
+}
+
+/* writePrefixed writes b to w with an RFC 1035 two-byte length prefix. */
+func writePrefixed(w io.Writer, b []byte) error {
+	if len(b) > maxTCPMessage {
+		return fmt.Errorf(
+			"message too large for TCP framing (%v bytes)",
+			len(b),
+		)
+	}
+	lb := make([]byte, 2, 2+len(b))
+	binary.BigEndian.PutUint16(lb, uint16(len(b)))
+	_, err := w.Write(append(lb, b...))
+	return err
+}
@@ -0,0 +1,90 @@
+package main
+
+/*
+ * handlequery.go
+ * Unpacks a DNS query and proxies it to the upstream pool
+ * By J. Stuart McMurray
+ * Created 20190921
+ * Last Modified 20190926
+ */
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// queryTimeout bounds how long resolveQuery waits for the upstream pool to
+// answer a single query.
+const queryTimeout = 5 * time.Second
+
+// resolveQuery unpacks the DNS query in b, checks it against acl (which may
+// be nil to disable ACL enforcement) returning a REFUSED answer if it's
+// denied, answers it from cache if possible (cache may be nil to disable
+// caching) and otherwise asks pool, and returns the original question, the
+// answer (with its ID set to match the query), and the client's requested
+// EDNS0 UDP payload size, for use when the reply is to be sent back over UDP
+// (0 if the query didn't include an OPT record).
+func resolveQuery(b []byte, addr net.Addr, pool *Pool, cache *Cache, acl *ACL) (dnsmessage.Question, dnsmessage.Message, int, error) {
+	/* Make sure the query is a DNS query */
+	var m dnsmessage.Message
+	if err := m.Unpack(b); nil != err {
+		return dnsmessage.Question{}, dnsmessage.Message{}, 0, fmt.Errorf(
+			"invalid query: %w",
+			err,
+		)
+	}
+
+	/* We only support one question at a time */
+	switch n := len(m.Questions); n {
+	case 0:
+		return dnsmessage.Question{}, dnsmessage.Message{}, 0, fmt.Errorf(
+			"no questions in query",
+		)
+	case 1: /* This is what we expect */
+	default:
+		return dnsmessage.Question{}, dnsmessage.Message{}, 0, fmt.Errorf(
+			"got %v questions in query, but only 1 question "+
+				"is supported",
+			n,
+		)
+	}
+	q := m.Questions[0]
+
+	/* We'll need to stick the ID in the response */
+	id := m.ID
+	usize := ednsUDPSize(m)
+
+	/* Refuse queries the ACL doesn't permit, rather than drop them
+	silently */
+	if nil != acl && !acl.Permit(addr, q) {
+		return q, refusedResponse(id, q), usize, nil
+	}
+
+	/* Serve from cache if we can */
+	if nil != cache {
+		if rm, ok := cache.Get(q, id); ok {
+			return q, rm, usize, nil
+		}
+	}
+
+	/* Race the query against the upstream pool */
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	rm, err := pool.Query(ctx, m)
+	if nil != err {
+		return dnsmessage.Question{}, dnsmessage.Message{}, 0, fmt.Errorf(
+			"querying upstreams: %w",
+			err,
+		)
+	}
+	if nil != cache {
+		cache.Put(q, rm)
+	}
+	rm.ID = id
+
+	return q, rm, usize, nil
+}
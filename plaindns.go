@@ -0,0 +1,97 @@
+package main
+
+/*
+ * plaindns.go
+ * Forwards DNS queries to a classic (non-DoH) DNS server over UDP/TCP
+ * By J. Stuart McMurray
+ * Created 20190925
+ * Last Modified 20190925
+ */
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// queryPlainDNS sends m to the classic DNS server at addr over UDP, falling
+// back to TCP if the UDP answer comes back truncated.
+func queryPlainDNS(ctx context.Context, m dnsmessage.Message, addr string) (dnsmessage.Message, error) {
+	qb, err := m.Pack()
+	if nil != err {
+		return dnsmessage.Message{}, fmt.Errorf("packing query: %w", err)
+	}
+
+	rm, err := queryPlainDNSUDP(ctx, qb, addr)
+	if nil != err {
+		return dnsmessage.Message{}, err
+	}
+	if !rm.Header.Truncated {
+		return rm, nil
+	}
+	return queryPlainDNSTCP(ctx, qb, addr)
+}
+
+/* queryPlainDNSUDP sends the packed query qb to addr over UDP. */
+func queryPlainDNSUDP(ctx context.Context, qb []byte, addr string) (dnsmessage.Message, error) {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "udp", addr)
+	if nil != err {
+		return dnsmessage.Message{}, fmt.Errorf("dialing %v: %w", addr, err)
+	}
+	defer c.Close()
+	if dl, ok := ctx.Deadline(); ok {
+		c.SetDeadline(dl)
+	}
+
+	if _, err := c.Write(qb); nil != err {
+		return dnsmessage.Message{}, fmt.Errorf("sending query: %w", err)
+	}
+	rb := make([]byte, buflen)
+	n, err := c.Read(rb)
+	if nil != err {
+		return dnsmessage.Message{}, fmt.Errorf("reading response: %w", err)
+	}
+
+	var rm dnsmessage.Message
+	if err := rm.Unpack(rb[:n]); nil != err {
+		return dnsmessage.Message{}, fmt.Errorf(
+			"unpacking response: %w",
+			err,
+		)
+	}
+	return rm, nil
+}
+
+// queryPlainDNSTCP sends the packed query qb to addr over TCP, RFC 1035
+// length-prefix framed.
+func queryPlainDNSTCP(ctx context.Context, qb []byte, addr string) (dnsmessage.Message, error) {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "tcp", addr)
+	if nil != err {
+		return dnsmessage.Message{}, fmt.Errorf("dialing %v: %w", addr, err)
+	}
+	defer c.Close()
+	if dl, ok := ctx.Deadline(); ok {
+		c.SetDeadline(dl)
+	}
+
+	if err := writePrefixed(c, qb); nil != err {
+		return dnsmessage.Message{}, fmt.Errorf("sending query: %w", err)
+	}
+	rb, err := readPrefixed(c)
+	if nil != err {
+		return dnsmessage.Message{}, fmt.Errorf("reading response: %w", err)
+	}
+
+	var rm dnsmessage.Message
+	if err := rm.Unpack(rb); nil != err {
+		return dnsmessage.Message{}, fmt.Errorf(
+			"unpacking response: %w",
+			err,
+		)
+	}
+	return rm, nil
+}
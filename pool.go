@@ -0,0 +1,158 @@
+package main
+
+/*
+ * pool.go
+ * Races queries across a pool of upstreams, favouring healthy ones
+ * By J. Stuart McMurray
+ * Created 20190924
+ * Last Modified 20190924
+ */
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Pool races a query against a number of Upstreams, preferring the
+// healthiest ones and giving the rest a head start delay, similar to a
+// resolver forwarder's backup-query behaviour.
+type Pool struct {
+	states      []*upstreamState
+	race        int
+	backupDelay time.Duration
+}
+
+// NewPool builds a Pool from ups.  race is the number of upstreams queried
+// in parallel for each lookup (0 or more than len(ups) means all of them);
+// backupDelay is the step by which each successive upstream after the first
+// is held back (the i-th is held back i*backupDelay), so a healthy upstream
+// gets a head start.
+func NewPool(ups []Upstream, race int, backupDelay time.Duration) *Pool {
+	states := make([]*upstreamState, len(ups))
+	for i, u := range ups {
+		states[i] = &upstreamState{u: u}
+	}
+	return &Pool{states: states, race: race, backupDelay: backupDelay}
+}
+
+/* upstreamState tracks recent health for a single Upstream. */
+type upstreamState struct {
+	u Upstream
+
+	mu         sync.Mutex
+	avgLatency time.Duration
+	errs       int /* consecutive errors */
+}
+
+// record updates u's health after a query either succeeded, taking dur, or
+// failed with err.
+func (s *upstreamState) record(dur time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if nil != err {
+		s.errs++
+		return
+	}
+	s.errs = 0
+	if 0 == s.avgLatency {
+		s.avgLatency = dur
+		return
+	}
+	/* Simple exponential moving average */
+	s.avgLatency = (s.avgLatency*3 + dur) / 4
+}
+
+// byHealth returns a copy of p's states, healthiest (fewest recent errors,
+// then lowest average latency) first.
+func (p *Pool) byHealth() []*upstreamState {
+	states := make([]*upstreamState, len(p.states))
+	copy(states, p.states)
+	sort.Slice(states, func(i, j int) bool {
+		a, b := states[i], states[j]
+		a.mu.Lock()
+		aErrs, aLat := a.errs, a.avgLatency
+		a.mu.Unlock()
+		b.mu.Lock()
+		bErrs, bLat := b.errs, b.avgLatency
+		b.mu.Unlock()
+		if aErrs != bErrs {
+			return aErrs < bErrs
+		}
+		return aLat < bLat
+	})
+	return states
+}
+
+/* queryResult is one upstream's answer to a race. */
+type queryResult struct {
+	st  *upstreamState
+	rm  dnsmessage.Message
+	err error
+	dur time.Duration
+}
+
+// Query races m against up to p.race upstreams and returns the first
+// NOERROR or NXDOMAIN answer, cancelling the rest.
+func (p *Pool) Query(ctx context.Context, m dnsmessage.Message) (dnsmessage.Message, error) {
+	if 0 == len(p.states) {
+		return dnsmessage.Message{}, fmt.Errorf("no upstreams configured")
+	}
+
+	order := p.byHealth()
+	n := p.race
+	if 0 >= n || n > len(order) {
+		n = len(order)
+	}
+	order = order[:n]
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	rch := make(chan queryResult, n)
+	for i, st := range order {
+		go func(i int, st *upstreamState) {
+			if 0 < i {
+				t := time.NewTimer(time.Duration(i) * p.backupDelay)
+				defer t.Stop()
+				select {
+				case <-ctx.Done():
+					rch <- queryResult{st: st, err: ctx.Err()}
+					return
+				case <-t.C:
+				}
+			}
+			start := time.Now()
+			rm, err := st.u.Query(ctx, m)
+			rch <- queryResult{st: st, rm: rm, err: err, dur: time.Since(start)}
+		}(i, st)
+	}
+
+	var lastErr error
+	for range order {
+		res := <-rch
+		res.st.record(res.dur, res.err)
+		if nil != res.err {
+			lastErr = fmt.Errorf("%v: %w", res.st.u, res.err)
+			continue
+		}
+		switch res.rm.Header.RCode {
+		case dnsmessage.RCodeSuccess, dnsmessage.RCodeNameError:
+			return res.rm, nil
+		default:
+			lastErr = fmt.Errorf(
+				"%v: rcode %v",
+				res.st.u,
+				res.rm.Header.RCode,
+			)
+		}
+	}
+	if nil == lastErr {
+		lastErr = fmt.Errorf("no upstream returned an answer")
+	}
+	return dnsmessage.Message{}, lastErr
+}
@@ -0,0 +1,307 @@
+package main
+
+/*
+ * servedoh.go
+ * Local DoH server, forwarding decoded requests as classic DNS queries
+ * By J. Stuart McMurray
+ * Created 20190925
+ * Last Modified 20190925
+ */
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// maxDoHBodyLen bounds how large a POSTed DoH request body is allowed to
+// be; a DNS message is at most maxTCPMessage bytes, and a few KB of slack
+// is plenty, so anything larger is a malicious or broken client rather
+// than a real query.
+const maxDoHBodyLen = maxTCPMessage + 4096
+
+// The doH*Timeout constants bound how long serveDoH will wait on a slow or idle
+// client, to avoid slowloris-style connection exhaustion on an
+// internet-facing DoH server.
+const (
+	doHReadHeaderTimeout = 5 * time.Second
+	doHReadTimeout       = 10 * time.Second
+	doHWriteTimeout      = 10 * time.Second
+	doHIdleTimeout       = 60 * time.Second
+)
+
+// dnsTypeByName lets /resolve clients name common RR types instead of
+// giving their numeric value, as Google's JSON API allows.
+var dnsTypeByName = map[string]dnsmessage.Type{
+	"A":     dnsmessage.TypeA,
+	"NS":    dnsmessage.TypeNS,
+	"CNAME": dnsmessage.TypeCNAME,
+	"SOA":   dnsmessage.TypeSOA,
+	"PTR":   dnsmessage.TypePTR,
+	"MX":    dnsmessage.TypeMX,
+	"TXT":   dnsmessage.TypeTXT,
+	"AAAA":  dnsmessage.TypeAAAA,
+	"SRV":   dnsmessage.TypeSRV,
+}
+
+// serveDoH starts an HTTPS server on laddr which accepts DoH requests on
+// /dns-query (RFC 8484 wire format) and /resolve (Google's JSON API, or wire
+// format if a ct=application/dns-message parameter is given), forwarding them
+// as plain DNS queries to the classic DNS server at upstream.
+func serveDoH(laddr, certFile, keyFile, upstream string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dns-query", func(w http.ResponseWriter, r *http.Request) {
+		handleDoHWire(w, r, upstream)
+	})
+	mux.HandleFunc("/resolve", func(w http.ResponseWriter, r *http.Request) {
+		handleDoHJSON(w, r, upstream)
+	})
+	srv := &http.Server{
+		Addr:              laddr,
+		Handler:           mux,
+		ReadHeaderTimeout: doHReadHeaderTimeout,
+		ReadTimeout:       doHReadTimeout,
+		WriteTimeout:      doHWriteTimeout,
+		IdleTimeout:       doHIdleTimeout,
+	}
+	log.Printf("Serving DoH requests on %v", laddr)
+	return srv.ListenAndServeTLS(certFile, keyFile)
+}
+
+// handleDoHWire serves RFC 8484 wire-format DoH requests, GET with a dns=
+// base64url parameter or POST with an application/dns-message body.
+func handleDoHWire(w http.ResponseWriter, r *http.Request, upstream string) {
+	var qb []byte
+	switch r.Method {
+	case http.MethodGet:
+		enc := r.URL.Query().Get("dns")
+		if "" == enc {
+			http.Error(w, "missing dns parameter", http.StatusBadRequest)
+			return
+		}
+		b, err := base64.RawURLEncoding.DecodeString(enc)
+		if nil != err {
+			http.Error(w, "invalid dns parameter", http.StatusBadRequest)
+			return
+		}
+		qb = b
+	case http.MethodPost:
+		if ctDNSMessage != r.Header.Get("Content-Type") {
+			http.Error(
+				w,
+				"unsupported content type",
+				http.StatusUnsupportedMediaType,
+			)
+			return
+		}
+		b, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxDoHBodyLen))
+		if nil != err {
+			http.Error(w, "error reading body", http.StatusBadRequest)
+			return
+		}
+		qb = b
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var m dnsmessage.Message
+	if err := m.Unpack(qb); nil != err {
+		http.Error(w, "invalid DNS message", http.StatusBadRequest)
+		return
+	}
+
+	rm, err := forwardDoHQuery(r.Context(), m, upstream)
+	if nil != err {
+		log.Printf("[%v] Error querying %v: %v", r.RemoteAddr, upstream, err)
+		http.Error(w, "upstream query failed", http.StatusBadGateway)
+		return
+	}
+
+	rb, err := rm.Pack()
+	if nil != err {
+		log.Printf("[%v] Error packing response: %v", r.RemoteAddr, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", ctDNSMessage)
+	w.Write(rb)
+}
+
+// handleDoHJSON serves Google-style JSON API requests, /resolve?name=&type=,
+// replying in wire format instead if a ct=application/dns-message parameter
+// is given, as queryJSON (the client side of the same convention) sends.
+func handleDoHJSON(w http.ResponseWriter, r *http.Request, upstream string) {
+	name := r.URL.Query().Get("name")
+	if "" == name {
+		http.Error(w, "missing name parameter", http.StatusBadRequest)
+		return
+	}
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+
+	typ := dnsmessage.TypeA
+	if ts := r.URL.Query().Get("type"); "" != ts {
+		if n, err := strconv.ParseUint(ts, 10, 16); nil == err {
+			typ = dnsmessage.Type(n)
+		} else if t, ok := dnsTypeByName[strings.ToUpper(ts)]; ok {
+			typ = t
+		} else {
+			http.Error(w, "invalid type parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	qname, err := dnsmessage.NewName(name)
+	if nil != err {
+		http.Error(w, "invalid name parameter", http.StatusBadRequest)
+		return
+	}
+	m := dnsmessage.Message{
+		Header: dnsmessage.Header{RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  qname,
+			Type:  typ,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+
+	rm, err := forwardDoHQuery(r.Context(), m, upstream)
+	if nil != err {
+		log.Printf("[%v] Error querying %v: %v", r.RemoteAddr, upstream, err)
+		http.Error(w, "upstream query failed", http.StatusBadGateway)
+		return
+	}
+
+	if ctDNSMessage == r.URL.Query().Get("ct") {
+		rb, err := rm.Pack()
+		if nil != err {
+			log.Printf("[%v] Error packing response: %v", r.RemoteAddr, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", ctDNSMessage)
+		w.Write(rb)
+		return
+	}
+	w.Header().Set("Content-Type", "application/dns-json")
+	if err := json.NewEncoder(w).Encode(newDoHJSONResponse(rm)); nil != err {
+		log.Printf("[%v] Error encoding response: %v", r.RemoteAddr, err)
+	}
+}
+
+// forwardDoHQuery forwards m to the classic DNS server at upstream and
+// returns the answer, with its ID set to match the query.
+func forwardDoHQuery(ctx context.Context, m dnsmessage.Message, upstream string) (dnsmessage.Message, error) {
+	id := m.ID
+	rm, err := queryPlainDNS(ctx, m, upstream)
+	if nil != err {
+		return dnsmessage.Message{}, err
+	}
+	rm.ID = id
+	return rm, nil
+}
+
+// dohJSONQuestion and dohJSONAnswer mirror the relevant fields of Google's
+// JSON DoH API's response schema.
+type dohJSONQuestion struct {
+	Name string `json:"name"`
+	Type int    `json:"type"`
+}
+type dohJSONAnswer struct {
+	Name string `json:"name"`
+	Type int    `json:"type"`
+	TTL  int    `json:"TTL"`
+	Data string `json:"data"`
+}
+type dohJSONResponseBody struct {
+	Status   int               `json:"Status"`
+	TC       bool              `json:"TC"`
+	RD       bool              `json:"RD"`
+	RA       bool              `json:"RA"`
+	Question []dohJSONQuestion `json:"Question"`
+	Answer   []dohJSONAnswer   `json:"Answer,omitempty"`
+}
+
+/* newDoHJSONResponse converts rm into Google's JSON DoH API's response shape. */
+func newDoHJSONResponse(rm dnsmessage.Message) dohJSONResponseBody {
+	resp := dohJSONResponseBody{
+		Status: int(rm.Header.RCode),
+		TC:     rm.Header.Truncated,
+		RD:     rm.Header.RecursionDesired,
+		RA:     rm.Header.RecursionAvailable,
+	}
+	for _, q := range rm.Questions {
+		resp.Question = append(resp.Question, dohJSONQuestion{
+			Name: q.Name.String(),
+			Type: int(q.Type),
+		})
+	}
+	for _, a := range rm.Answers {
+		resp.Answer = append(resp.Answer, dohJSONAnswer{
+			Name: a.Header.Name.String(),
+			Type: int(a.Header.Type),
+			TTL:  int(a.Header.TTL),
+			Data: rrDataString(a),
+		})
+	}
+	return resp
+}
+
+// rrDataString renders a resource's data the way Google's JSON API does,
+// for the common RR types; unrecognised types render as an empty string.
+func rrDataString(r dnsmessage.Resource) string {
+	switch b := r.Body.(type) {
+	case *dnsmessage.AResource:
+		return fmt.Sprintf("%d.%d.%d.%d", b.A[0], b.A[1], b.A[2], b.A[3])
+	case *dnsmessage.AAAAResource:
+		return aaaaString(b.AAAA)
+	case *dnsmessage.CNAMEResource:
+		return b.CNAME.String()
+	case *dnsmessage.NSResource:
+		return b.NS.String()
+	case *dnsmessage.PTRResource:
+		return b.PTR.String()
+	case *dnsmessage.MXResource:
+		return fmt.Sprintf("%d %s", b.Pref, b.MX.String())
+	case *dnsmessage.TXTResource:
+		return strings.Join(b.TXT, " ")
+	case *dnsmessage.SRVResource:
+		return fmt.Sprintf(
+			"%d %d %d %s",
+			b.Priority,
+			b.Weight,
+			b.Port,
+			b.Target.String(),
+		)
+	case *dnsmessage.SOAResource:
+		return fmt.Sprintf(
+			"%s %s %d %d %d %d %d",
+			b.NS.String(),
+			b.MBox.String(),
+			b.Serial,
+			b.Refresh,
+			b.Retry,
+			b.Expire,
+			b.MinTTL,
+		)
+	default:
+		return ""
+	}
+}
+
+/* aaaaString renders a 16-byte IPv6 address using net's usual shorthand. */
+func aaaaString(a [16]byte) string {
+	return net.IP(a[:]).String()
+}
@@ -0,0 +1,88 @@
+package main
+
+/*
+ * tcp.go
+ * Serves DNS queries over TCP, RFC 1035 length-prefix framing
+ * By J. Stuart McMurray
+ * Created 20190923
+ * Last Modified 20190926
+ */
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+)
+
+// maxTCPMessage is the largest DNS message RFC 1035's two-byte length
+// prefix can describe.
+const maxTCPMessage = 65535
+
+// serveTCP listens for DNS queries on laddr and proxies them to pool,
+// consulting cache first (cache may be nil to disable caching) and acl before
+// either (acl may be nil to disable ACL enforcement).
+func serveTCP(laddr string, pool *Pool, cache *Cache, acl *ACL) error {
+	la, err := net.ResolveTCPAddr("tcp", laddr)
+	if nil != err {
+		return fmt.Errorf("resolving TCP address %v: %w", laddr, err)
+	}
+	l, err := net.ListenTCP("tcp", la)
+	if nil != err {
+		return fmt.Errorf("listening on %v: %w", la, err)
+	}
+	log.Printf("Listening for DNS queries on %v/tcp", l.Addr())
+
+	for {
+		c, err := l.Accept()
+		if nil != err {
+			return fmt.Errorf("accepting connection: %w", err)
+		}
+		go handleTCPConn(c, pool, cache, acl)
+	}
+}
+
+// handleTCPConn serves DNS queries, each framed with a two-byte length
+// prefix, from c until it's closed or a framing error occurs.
+func handleTCPConn(c net.Conn, pool *Pool, cache *Cache, acl *ACL) {
+	defer c.Close()
+	tag := c.RemoteAddr().String()
+
+	for {
+		qb, err := readPrefixed(c)
+		if nil != err {
+			if io.EOF != err {
+				log.Printf("[%v] Reading query: %v", tag, err)
+			}
+			return
+		}
+
+		if !handleTCPQuery(c, tag, qb, pool, cache, acl) {
+			return
+		}
+	}
+}
+
+// handleTCPQuery resolves the query in qb and sends the full (never
+// truncated) answer back on c, length-prefixed.  It returns false if c should
+// be closed.
+func handleTCPQuery(c net.Conn, tag string, qb []byte, pool *Pool, cache *Cache, acl *ACL) bool {
+	q, rm, _, err := resolveQuery(qb, c.RemoteAddr(), pool, cache, acl)
+	if nil != err {
+		log.Printf("[%v] %v", tag, err)
+		return true
+	}
+	tag = fmt.Sprintf("%s-%s/%s", tag, q.Name, q.Type)
+
+	rb, err := rm.Pack()
+	if nil != err {
+		log.Printf("[%v] Error packing DNS response: %v", tag, err)
+		return true
+	}
+	if err := writePrefixed(c, rb); nil != err {
+		log.Printf("[%v] Error sending response: %v", tag, err)
+		return false
+	}
+	log.Printf("[%v] %s %s", tag, q.Name, q.Type)
+	return true
+}
@@ -0,0 +1,70 @@
+package main
+
+/*
+ * udp.go
+ * Serves DNS queries over UDP
+ * By J. Stuart McMurray
+ * Created 20190923
+ * Last Modified 20190926
+ */
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+)
+
+// serveUDP listens for DNS queries on laddr and proxies them to pool,
+// consulting cache first (cache may be nil to disable caching) and acl before
+// either (acl may be nil to disable ACL enforcement).
+func serveUDP(laddr string, pool *Pool, cache *Cache, acl *ACL) error {
+	la, err := net.ResolveUDPAddr("udp", laddr)
+	if nil != err {
+		return fmt.Errorf("resolving UDP address %v: %w", laddr, err)
+	}
+	uc, err := net.ListenUDP("udp", la)
+	if nil != err {
+		return fmt.Errorf("listening on %v: %w", la, err)
+	}
+	log.Printf("Listening for DNS queries on %v/udp", uc.LocalAddr())
+
+	bufPool := &sync.Pool{New: func() interface{} {
+		return make([]byte, buflen)
+	}}
+	for {
+		b := bufPool.Get().([]byte)
+		n, a, err := uc.ReadFrom(b)
+		if nil != err {
+			return fmt.Errorf("reading query: %w", err)
+		}
+		go func() {
+			handleUDPQuery(uc, a, b[:n], pool, cache, acl)
+			bufPool.Put(b)
+		}()
+	}
+}
+
+// handleUDPQuery resolves the query in b and sends the (possibly
+// truncated) answer back to a on uc.
+func handleUDPQuery(uc *net.UDPConn, a net.Addr, b []byte, pool *Pool, cache *Cache, acl *ACL) {
+	tag := a.String()
+
+	q, rm, usize, err := resolveQuery(b, a, pool, cache, acl)
+	if nil != err {
+		log.Printf("[%v] %v", tag, err)
+		return
+	}
+	tag = fmt.Sprintf("%s-%s/%s", a, q.Name, q.Type)
+
+	rb, err := packForUDP(rm, usize)
+	if nil != err {
+		log.Printf("[%v] Error packing DNS response: %v", tag, err)
+		return
+	}
+	if _, err := uc.WriteTo(rb, a); nil != err {
+		log.Printf("[%v] Error sending response: %v", tag, err)
+		return
+	}
+	log.Printf("[%v] %s %s", tag, q.Name, q.Type)
+}
@@ -0,0 +1,154 @@
+package main
+
+/*
+ * upstream.go
+ * Upstream DoH/DoT server implementations
+ * By J. Stuart McMurray
+ * Created 20190924
+ * Last Modified 20190925
+ */
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+/* Upstream is a server which can answer a DNS query. */
+type Upstream interface {
+	/* Query sends m upstream and returns the answer. */
+	Query(ctx context.Context, m dnsmessage.Message) (dnsmessage.Message, error)
+	/* String returns a human-readable name for logging. */
+	String() string
+}
+
+// upstreamFlag implements flag.Value, collecting the values of a
+// repeated -upstream flag.
+type upstreamFlag []string
+
+func (f *upstreamFlag) String() string { return fmt.Sprint([]string(*f)) }
+func (f *upstreamFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+// parseUpstream parses a -upstream flag's value into an Upstream.  Accepted
+// forms are:
+//
+//	google:<sni>[,json|,wire]   Domain-fronted Google DoH (default mode json)
+//	doh:<url>                   Plain RFC 8484 DoH, e.g. doh:https://dns.google/dns-query
+//	dot:<host:port>             DNS over TLS, e.g. dot:1.1.1.1:853
+func parseUpstream(spec string) (Upstream, error) {
+	scheme, rest := spec, ""
+	if i := strings.IndexByte(spec, ':'); -1 != i {
+		scheme, rest = spec[:i], spec[i+1:]
+	}
+	switch scheme {
+	case "google":
+		sni, mode := rest, modeJSON
+		if i := strings.IndexByte(rest, ','); -1 != i {
+			sni, mode = rest[:i], rest[i+1:]
+		}
+		if "" == sni {
+			return nil, fmt.Errorf("google upstream needs an SNI")
+		}
+		switch mode {
+		case modeJSON, modeWire: /* Valid */
+		default:
+			return nil, fmt.Errorf("invalid google upstream mode %q", mode)
+		}
+		return &googleUpstream{sni: sni, mode: mode}, nil
+	case "doh":
+		if "" == rest {
+			return nil, fmt.Errorf("doh upstream needs a URL")
+		}
+		return &dohUpstream{url: rest}, nil
+	case "dot":
+		if "" == rest {
+			return nil, fmt.Errorf("dot upstream needs a host:port")
+		}
+		return &dotUpstream{addr: rest}, nil
+	default:
+		return nil, fmt.Errorf("unknown upstream type %q", scheme)
+	}
+}
+
+// googleUpstream queries Google's DoH service, using domain fronting via
+// sni, in either the JSON or wire-format mode.
+type googleUpstream struct {
+	sni  string
+	mode string
+}
+
+func (u *googleUpstream) Query(ctx context.Context, m dnsmessage.Message) (dnsmessage.Message, error) {
+	if modeWire == u.mode {
+		return queryWire(ctx, m, u.sni)
+	}
+	return queryJSON(ctx, m, u.sni)
+}
+
+func (u *googleUpstream) String() string {
+	return fmt.Sprintf("google(%s,%s)", u.sni, u.mode)
+}
+
+/* dohUpstream queries a plain (non-fronted) RFC 8484 DoH server at url. */
+type dohUpstream struct {
+	url string
+}
+
+func (u *dohUpstream) Query(ctx context.Context, m dnsmessage.Message) (dnsmessage.Message, error) {
+	req, err := newWireRequest(ctx, u.url, m)
+	if nil != err {
+		return dnsmessage.Message{}, err
+	}
+	return doDoHRequest(req)
+}
+
+func (u *dohUpstream) String() string { return u.url }
+
+// dotUpstream queries a DNS-over-TLS server at addr (host:port), using
+// RFC 1035 two-byte length-prefix framing over the TLS connection.
+type dotUpstream struct {
+	addr string
+}
+
+func (u *dotUpstream) Query(ctx context.Context, m dnsmessage.Message) (dnsmessage.Message, error) {
+	c, err := (&tls.Dialer{}).DialContext(ctx, "tcp", u.addr)
+	if nil != err {
+		return dnsmessage.Message{}, fmt.Errorf("dialing %v: %w", u.addr, err)
+	}
+	defer c.Close()
+	if dl, ok := ctx.Deadline(); ok {
+		c.SetDeadline(dl)
+	}
+
+	qb, err := m.Pack()
+	if nil != err {
+		return dnsmessage.Message{}, fmt.Errorf("packing query: %w", err)
+	}
+	if err := writePrefixed(c, qb); nil != err {
+		return dnsmessage.Message{}, fmt.Errorf("sending query: %w", err)
+	}
+	rb, err := readPrefixed(c)
+	if nil != err {
+		return dnsmessage.Message{}, fmt.Errorf(
+			"reading response: %w",
+			err,
+		)
+	}
+
+	var rm dnsmessage.Message
+	if err := rm.Unpack(rb); nil != err {
+		return dnsmessage.Message{}, fmt.Errorf(
+			"unpacking response %q: %w",
+			rb,
+			err,
+		)
+	}
+	return rm, nil
+}
+
+func (u *dotUpstream) String() string { return "dot://" + u.addr }